@@ -16,6 +16,7 @@
 package dag
 
 import (
+	"fmt"
 	"time"
 
 	"k8s.io/api/core/v1"
@@ -49,9 +50,17 @@ func (d *DAG) Statuses() []Status {
 }
 
 type Route struct {
-	Prefix       string
-	object       interface{} // one of Ingress or IngressRoute
-	httpServices map[servicemeta]*HTTPService
+	Prefix string
+	object interface{} // one of Ingress or IngressRoute
+
+	// httpServices holds the ordered list of weighted destinations this
+	// Route fans out to. Each HTTPService carries its own Weight and
+	// optional Subset, so a single prefix can split traffic across
+	// several subsets of the same Service (or across distinct Services)
+	// by percentage, the way a VirtualHost splits across DestinationRule
+	// subsets in Istio. The order is insertion order, which is what a
+	// weighted_clusters route needs to render deterministically.
+	httpServices []*HTTPService
 
 	// Should this route generate a 301 upgrade if accessed
 	// over HTTP?
@@ -81,6 +90,114 @@ type Route struct {
 
 	// Indicates that during forwarding, the matched prefix (or path) should be swapped with this value
 	PrefixRewrite string
+
+	// CorsPolicy, if set, configures Envoy's CORS filter for requests
+	// matching this Route. A nil CorsPolicy means no CORS handling is
+	// configured and browser cross-origin requests are left to the
+	// backend to answer (or reject).
+	CorsPolicy *CorsPolicy
+
+	// FaultInjection, if set, configures Envoy's fault filter to delay
+	// and/or abort a percentage of requests matching this Route. A nil
+	// FaultInjection means no fault is injected.
+	FaultInjection *FaultInjection
+}
+
+// FaultInjection configures Envoy's HTTP fault filter for a Route: an
+// artificial delay, an artificial abort, or both, optionally scoped to
+// requests carrying a matching header.
+//
+// TODO(this series): this is DAG-layer model only. Parsing a fault
+// stanza off IngressRoute and configuring Envoy's fault filter from the
+// RDS/HCM visitor are not yet implemented in this tree.
+type FaultInjection struct {
+	// Delay, if set, injects a delay before forwarding a percentage of
+	// requests.
+	Delay *FaultDelay
+
+	// Abort, if set, fails a percentage of requests with a fixed HTTP
+	// status instead of forwarding them.
+	Abort *FaultAbort
+
+	// Headers optionally restricts the fault to requests whose headers
+	// match all of these conditions. An empty list applies the fault to
+	// all requests matching the Route.
+	Headers []HeaderCondition
+}
+
+// FaultDelay describes an artificial delay injected before a request is
+// forwarded to its upstream.
+type FaultDelay struct {
+	// FixedDelay is the delay to inject. Ignored if ExponentialMean is set.
+	FixedDelay time.Duration
+
+	// ExponentialMean is the mean of an exponentially distributed delay.
+	// Mutually exclusive with FixedDelay.
+	ExponentialMean time.Duration
+
+	// Percent is the percentage of requests, 0-100, that receive the delay.
+	Percent int
+}
+
+// FaultAbort describes an artificial failure response returned instead of
+// forwarding a request to its upstream.
+type FaultAbort struct {
+	// HTTPStatus is the HTTP status code returned for aborted requests.
+	HTTPStatus int
+
+	// Percent is the percentage of requests, 0-100, that are aborted.
+	Percent int
+}
+
+// HeaderCondition matches a single request header by exact value or,
+// if Regex is true, by regular expression.
+type HeaderCondition struct {
+	Name  string
+	Value string
+	Regex bool
+}
+
+// CorsOriginMatch matches a single allowed CORS origin by exact value or,
+// if Regex is true, by regular expression, mirroring HeaderCondition.
+type CorsOriginMatch struct {
+	Origin string
+	Regex  bool
+}
+
+// CorsPolicy configures Envoy's Cross-Origin Resource Sharing filter for a
+// Route, sourced from a corspolicy stanza on IngressRoute.
+//
+// TODO(this series): this is DAG-layer model only. Parsing the corspolicy
+// stanza, validating it (e.g. AllowCredentials forbidding a wildcard
+// AllowOrigin), recording validation failures under Status, and emitting
+// Envoy's cors filter config from the RDS visitor are not yet implemented
+// in this tree.
+type CorsPolicy struct {
+	// AllowCredentials indicates whether the browser should include
+	// credentials (cookies, auth headers) with cross-origin requests.
+	// Mutually exclusive with a wildcard entry in AllowOrigin.
+	AllowCredentials bool
+
+	// AllowOrigin is the list of origins that are allowed to make
+	// cross-origin requests.
+	AllowOrigin []CorsOriginMatch
+
+	// AllowMethods is the list of HTTP methods allowed for cross-origin
+	// requests, returned in the Access-Control-Allow-Methods header.
+	AllowMethods []string
+
+	// AllowHeaders is the list of request headers allowed for
+	// cross-origin requests, returned in the Access-Control-Allow-Headers
+	// header.
+	AllowHeaders []string
+
+	// ExposeHeaders is the list of response headers browsers are
+	// permitted to expose to cross-origin callers.
+	ExposeHeaders []string
+
+	// MaxAge specifies how long the results of a preflight request can
+	// be cached. A zero value means Envoy's default.
+	MaxAge time.Duration
 }
 
 type ServiceVertex interface {
@@ -89,10 +206,17 @@ type ServiceVertex interface {
 }
 
 func (r *Route) addService(sv ServiceVertex) {
-	if r.httpServices == nil {
-		r.httpServices = make(map[servicemeta]*HTTPService)
+	http := sv.(*HTTPService)
+	meta := sv.toMeta()
+	for i, existing := range r.httpServices {
+		if existing.toMeta() == meta {
+			// Replace in place so the destination keeps its original
+			// position and the ordering stays deterministic.
+			r.httpServices[i] = http
+			return
+		}
 	}
-	r.httpServices[sv.toMeta()] = sv.(*HTTPService)
+	r.httpServices = append(r.httpServices, http)
 }
 
 func (r *Route) Visit(f func(Vertex)) {
@@ -133,6 +257,11 @@ type SecureVirtualHost struct {
 	MinProtoVersion auth.TlsParameters_TlsProtocol
 
 	secret *Secret
+
+	// TCPProxy, if set, routes raw TCP on this SecureVirtualHost's SNI
+	// straight to a backend without HTTP parsing, and is mutually
+	// exclusive with the VirtualHost's HTTP routes.
+	TCPProxy *TCPProxy
 }
 
 func (s *SecureVirtualHost) Data() map[string][]byte {
@@ -143,8 +272,21 @@ func (s *SecureVirtualHost) Data() map[string][]byte {
 }
 
 func (s *SecureVirtualHost) Visit(f func(Vertex)) {
-	s.VirtualHost.Visit(f)
 	f(s.secret)
+	if s.TCPProxy != nil {
+		// TCPProxy is mutually exclusive with HTTP routes on the same
+		// SecureVirtualHost (see TCPProxy's doc comment), so a visitor
+		// is only ever handed one or the other, never both, even if a
+		// SecureVirtualHost somehow ends up with both populated.
+		//
+		// TODO(this series): the DAG builder is supposed to reject an
+		// IngressRoute that sets both a tcpproxy and routes stanza
+		// before it ever reaches this point; that validation doesn't
+		// exist yet in this tree.
+		f(s.TCPProxy)
+		return
+	}
+	s.VirtualHost.Visit(f)
 }
 
 type Visitable interface {
@@ -184,6 +326,48 @@ type Service struct {
 	// MaxRetries is the maximum number of parallel retries that
 	// Envoy will allow to the upstream cluster.
 	MaxRetries int
+
+	// OutlierDetection configures passive health checking: Envoy ejects
+	// endpoints from the load balancing pool based on their observed
+	// error behaviour rather than a dedicated active health check probe.
+	// A nil OutlierDetection disables passive ejection.
+	OutlierDetection *OutlierDetection
+}
+
+// OutlierDetection configures Envoy's passive health checking for a
+// cluster, ejecting endpoints that return errors at an unacceptable rate
+// from the load balancing pool. It mirrors the passive-ejection half of
+// the DestinationRule health checking model: HealthCheck on HTTPService
+// covers active probing, OutlierDetection covers passive ejection.
+//
+// TODO(this series): this is DAG-layer model only. The CDS visitor does
+// not yet read this field to emit an Envoy outlier_detection config.
+type OutlierDetection struct {
+	// ConsecutiveServerErrors is the number of consecutive 5xx responses
+	// (or connection failures) before an endpoint is ejected.
+	ConsecutiveServerErrors int
+
+	// ConsecutiveGatewayErrors is the number of consecutive gateway
+	// errors (502/503/504) before an endpoint is ejected.
+	ConsecutiveGatewayErrors int
+
+	// Interval is the time between ejection sweeps.
+	Interval time.Duration
+
+	// BaseEjectionTime is the minimum duration an endpoint stays
+	// ejected. Actual ejection time is this value multiplied by the
+	// number of times the endpoint has been ejected so far.
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionPercent is the maximum percentage of endpoints in the
+	// cluster that may be ejected at once.
+	MaxEjectionPercent int
+}
+
+// outlierDetectionToString renders an OutlierDetection for inclusion in a
+// servicemeta key, the same way healthcheckToString does for HealthCheck.
+func outlierDetectionToString(o *OutlierDetection) string {
+	return fmt.Sprintf("%#v", o)
 }
 
 func (s *Service) Name() string      { return s.Object.Name }
@@ -199,33 +383,241 @@ type HTTPService struct {
 	Protocol string
 
 	HealthCheck *ingressroutev1.HealthCheck // TODO(dfc) HealthCheck should be generalised and moved to Service.
+
+	// Subset, if set, restricts this destination to the slice of the
+	// Service's endpoints matching the Subset's label selector, and may
+	// carry a TrafficPolicy overriding the Service's defaults for that
+	// slice. A nil Subset targets the whole Service.
+	Subset *Subset
+
+	// UpstreamTLS, if set, configures Envoy to originate TLS to this
+	// destination instead of speaking plaintext, for talking to
+	// upstreams protected by service-mesh style workload identities.
+	UpstreamTLS *UpstreamTLS
 }
 
-func (s *HTTPService) Visit(func(Vertex)) {
+func (s *HTTPService) Visit(f func(Vertex)) {
 	// Visit is defined on HTTPService, not Service, so the latter
 	// cannot be inserted into the DAG nor interface asserted from a Vertex.
+	if s.UpstreamTLS != nil && s.UpstreamTLS.clientSecret != nil {
+		f(s.UpstreamTLS.clientSecret)
+	}
+}
+
+// UpstreamTLSMode selects how Envoy originates TLS to an upstream cluster.
+type UpstreamTLSMode int
+
+const (
+	// UpstreamTLSDisable speaks plaintext to the upstream. This is the default.
+	UpstreamTLSDisable UpstreamTLSMode = iota
+
+	// UpstreamTLSSimple originates TLS without presenting a client certificate.
+	UpstreamTLSSimple
+
+	// UpstreamTLSMutual originates TLS and presents a client certificate
+	// sourced from the referenced Secret.
+	UpstreamTLSMutual
+)
+
+// UpstreamTLS describes how Envoy should originate TLS to an HTTPService,
+// mirroring the upstream half of a service-mesh workload identity: which
+// SNI to present, which SANs the upstream certificate must carry, and
+// which client certificate to use for mutual TLS.
+//
+// TODO(this series): this is DAG-layer model only. Resolving the
+// referenced client-cert Secret as a builder-added child vertex (the
+// clientSecret field and addClientSecret exist for this, but nothing
+// calls addClientSecret yet) and emitting an UpstreamTlsContext from the
+// CDS visitor are not yet implemented in this tree.
+type UpstreamTLS struct {
+	// Mode selects whether, and how, Envoy originates TLS to this upstream.
+	Mode UpstreamTLSMode
+
+	// SNI overrides the SNI servername Envoy presents when originating
+	// TLS. If empty, Envoy falls back to the Service's hostname.
+	SNI string
+
+	// SubjectAltNames, if non-empty, restricts the upstream certificate
+	// Envoy will accept to one presenting at least one of these SANs.
+	SubjectAltNames []string
+
+	// clientSecret is the client certificate/key Envoy presents when
+	// Mode is UpstreamTLSMutual. When set, HTTPService.Visit hands it to
+	// visitors as a child vertex, the way SecureVirtualHost.Visit hands
+	// over its server secret. It is set only through addClientSecret,
+	// which nothing in this tree calls, so it is nil unless set directly.
+	clientSecret *Secret
+}
+
+func (u *UpstreamTLS) addClientSecret(secret *Secret) {
+	u.clientSecret = secret
+}
+
+// upstreamTLSToString renders an UpstreamTLS for inclusion in a servicemeta
+// key, the same way healthcheckToString does for HealthCheck. It formats
+// clientSecret by name/namespace rather than %#v-ing the struct directly,
+// since %#v of a nested pointer field prints its address, not its
+// contents, and would defeat the dedup this key exists for.
+func upstreamTLSToString(u *UpstreamTLS) string {
+	if u == nil {
+		return "<nil>"
+	}
+	secretNamespace, secretName := "", ""
+	if u.clientSecret != nil {
+		secretNamespace, secretName = u.clientSecret.Namespace(), u.clientSecret.Name()
+	}
+	return fmt.Sprintf("%#v/secret:%s/%s", struct {
+		Mode            UpstreamTLSMode
+		SNI             string
+		SubjectAltNames []string
+	}{u.Mode, u.SNI, u.SubjectAltNames}, secretNamespace, secretName)
 }
 
 type servicemeta struct {
-	name        string
-	namespace   string
-	port        int32
-	weight      int
-	strategy    string
-	healthcheck string // %#v of *ingressroutev1.HealthCheck
+	name         string
+	namespace    string
+	port         int32
+	weight       int
+	strategy     string
+	healthcheck  string // %#v of *ingressroutev1.HealthCheck
+	subset       string // name of the Subset this destination targets, or "" for the whole Service
+	subsetPolicy string // trafficPolicyToString of the Subset's *TrafficPolicy, so subsets with distinct per-subset policies are not deduped
+	outlier      string // %#v of *OutlierDetection, so distinct passive health checks are not deduped
+	upstreamTLS  string // upstreamTLSToString of *UpstreamTLS, so distinct upstream TLS profiles are not deduped
+}
+
+// trafficPolicyToString renders a TrafficPolicy for inclusion in a
+// servicemeta key, the same way healthcheckToString does for HealthCheck.
+// OutlierDetection is rendered through outlierDetectionToString rather
+// than %#v-ed as part of the struct, since %#v of a nested pointer field
+// prints its address, not its contents, and would defeat the dedup this
+// key exists for.
+func trafficPolicyToString(t *TrafficPolicy) string {
+	if t == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%#v/outlier:%s", struct {
+		LoadBalancerStrategy string
+		MaxConnections       int
+		MaxPendingRequests   int
+		MaxRequests          int
+		MaxRetries           int
+	}{t.LoadBalancerStrategy, t.MaxConnections, t.MaxPendingRequests, t.MaxRequests, t.MaxRetries}, outlierDetectionToString(t.OutlierDetection))
 }
 
 func (s *HTTPService) toMeta() servicemeta {
+	subset := ""
+	subsetPolicy := ""
+	if s.Subset != nil {
+		subset = s.Subset.Name
+		subsetPolicy = trafficPolicyToString(s.Subset.TrafficPolicy)
+	}
 	return servicemeta{
-		name:        s.Object.Name,
-		namespace:   s.Object.Namespace,
-		port:        s.Port,
-		weight:      s.Weight,
-		strategy:    s.LoadBalancerStrategy,
-		healthcheck: healthcheckToString(s.HealthCheck),
+		name:         s.Object.Name,
+		namespace:    s.Object.Namespace,
+		port:         s.Port,
+		weight:       s.Weight,
+		strategy:     s.LoadBalancerStrategy,
+		healthcheck:  healthcheckToString(s.HealthCheck),
+		subset:       subset,
+		subsetPolicy: subsetPolicy,
+		outlier:      outlierDetectionToString(s.OutlierDetection),
+		upstreamTLS:  upstreamTLSToString(s.UpstreamTLS),
 	}
 }
 
+// TCPProxy represents the rendering of a TCPProxy filter chain applied to
+// a SecureVirtualHost. Unlike a Route, a TCPProxy forwards raw TCP keyed
+// only on the TLS SNI servername; no HTTP parsing takes place.
+//
+// TODO(this series): this is DAG-layer model only. Parsing a tcpproxy
+// stanza off IngressRoute (including rejecting it alongside a routes
+// stanza on the same host), surfacing that validation under Status, and
+// emitting a TLS inspector + tcp_proxy filter chain from the LDS visitor
+// are not yet implemented in this tree; see SecureVirtualHost.Visit for
+// the model-level exclusivity guard this leans on in the meantime.
+type TCPProxy struct {
+	// service is the single backend this TCPProxy forwards to.
+	service *TCPService
+}
+
+func (t *TCPProxy) addService(svc *TCPService) {
+	t.service = svc
+}
+
+func (t *TCPProxy) Visit(f func(Vertex)) {
+	f(t.service)
+}
+
+// TCPService represents a Kubernetes Service object proxied over raw TCP,
+// as opposed to an HTTPService which is proxied as HTTP/1.1 or HTTP/2.0.
+type TCPService struct {
+	Service
+}
+
+func (s *TCPService) Visit(func(Vertex)) {
+	// Visit is defined on TCPService, not Service, so the latter
+	// cannot be inserted into the DAG nor interface asserted from a Vertex.
+}
+
+// Subset identifies a labelled slice of the Pods backing a Service, analogous
+// to an Istio DestinationRule subset. A Route may fan out to several Subsets
+// of the same Service, each weighted independently, to support canary and
+// blue/green style traffic splits.
+//
+// TODO(this series): this is DAG-layer model only. Resolving Selector
+// against a Service's endpoints, parsing a subsets stanza on IngressRoute,
+// and emitting weighted_clusters from the CDS/RDS visitors are not yet
+// implemented in this tree.
+type Subset struct {
+	// Name identifies this subset within the owning Service, for example "canary".
+	Name string
+
+	// Selector is a label selector matched against the Pods backing the
+	// Service. Only endpoints whose Pod carries all of these labels belong
+	// to this Subset.
+	Selector map[string]string
+
+	// TrafficPolicy optionally overrides the load balancing, connection
+	// pool, and outlier detection behaviour applied to traffic sent to
+	// this Subset. A nil TrafficPolicy inherits the owning Service's
+	// defaults.
+	TrafficPolicy *TrafficPolicy
+}
+
+// TrafficPolicy describes how Envoy should treat traffic bound for a
+// Service or Subset: which load balancing strategy to use, the connection
+// pool limits to enforce, and the passive health checking (outlier
+// detection) to apply.
+type TrafficPolicy struct {
+	// The load balancer type to use when picking a host in the cluster.
+	// See https://www.envoyproxy.io/docs/envoy/latest/api-v2/api/v2/cds.proto#envoy-api-enum-cluster-lbpolicy
+	LoadBalancerStrategy string
+
+	// Circuit breaking limits
+
+	// MaxConnections is maximum number of connections
+	// that Envoy will make to the upstream cluster.
+	MaxConnections int
+
+	// MaxPendingRequests is maximum number of pending
+	// requests that Envoy will allow to the upstream cluster.
+	MaxPendingRequests int
+
+	// MaxRequests is the maximum number of parallel requests that
+	// Envoy will make to the upstream cluster.
+	MaxRequests int
+
+	// MaxRetries is the maximum number of parallel retries that
+	// Envoy will allow to the upstream cluster.
+	MaxRetries int
+
+	// OutlierDetection overrides the owning Service's passive health
+	// checking for traffic sent to this Subset. A nil value inherits
+	// the Service's OutlierDetection.
+	OutlierDetection *OutlierDetection
+}
+
 // Secret represents a K8s Secret for TLS usage as a DAG Vertex. A Secret is
 // a leaf in the DAG.
 type Secret struct {
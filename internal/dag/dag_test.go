@@ -0,0 +1,126 @@
+// Copyright © 2018 Heptio
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dag
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestHTTPServiceToMetaEquality guards the servicemeta dedup key: two
+// HTTPServices with the same logical Subset/OutlierDetection/UpstreamTLS
+// settings, but built from separately allocated structs (the normal case
+// each time the builder parses an IngressRoute), must produce an equal
+// servicemeta so they dedupe onto one cluster. It also checks that a
+// genuine difference in a Subset's outlier settings, or in the UpstreamTLS
+// client secret, is still detected.
+func TestHTTPServiceToMetaEquality(t *testing.T) {
+	svc := func() *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"},
+		}
+	}
+	port := func() *v1.ServicePort {
+		return &v1.ServicePort{Port: 80}
+	}
+	clientSecret := func(name string) *Secret {
+		return &Secret{object: &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		}}
+	}
+
+	tests := map[string]struct {
+		a, b *HTTPService
+		want bool
+	}{
+		"equal subset with freshly allocated equal TrafficPolicy dedupes": {
+			a: &HTTPService{
+				Service: Service{Object: svc(), ServicePort: port()},
+				Subset: &Subset{
+					Name: "canary",
+					TrafficPolicy: &TrafficPolicy{
+						LoadBalancerStrategy: "round_robin",
+						OutlierDetection:     &OutlierDetection{ConsecutiveServerErrors: 5},
+					},
+				},
+			},
+			b: &HTTPService{
+				Service: Service{Object: svc(), ServicePort: port()},
+				Subset: &Subset{
+					Name: "canary",
+					TrafficPolicy: &TrafficPolicy{
+						LoadBalancerStrategy: "round_robin",
+						OutlierDetection:     &OutlierDetection{ConsecutiveServerErrors: 5},
+					},
+				},
+			},
+			want: true,
+		},
+		"subset TrafficPolicy with different outlier settings does not dedupe": {
+			a: &HTTPService{
+				Service: Service{Object: svc(), ServicePort: port()},
+				Subset: &Subset{
+					Name:          "canary",
+					TrafficPolicy: &TrafficPolicy{OutlierDetection: &OutlierDetection{ConsecutiveServerErrors: 5}},
+				},
+			},
+			b: &HTTPService{
+				Service: Service{Object: svc(), ServicePort: port()},
+				Subset: &Subset{
+					Name:          "canary",
+					TrafficPolicy: &TrafficPolicy{OutlierDetection: &OutlierDetection{ConsecutiveServerErrors: 10}},
+				},
+			},
+			want: false,
+		},
+		"equal freshly allocated Service OutlierDetection dedupes": {
+			a:    &HTTPService{Service: Service{Object: svc(), ServicePort: port(), OutlierDetection: &OutlierDetection{MaxEjectionPercent: 50}}},
+			b:    &HTTPService{Service: Service{Object: svc(), ServicePort: port(), OutlierDetection: &OutlierDetection{MaxEjectionPercent: 50}}},
+			want: true,
+		},
+		"equal UpstreamTLS pointing at distinct but equal client secrets dedupes": {
+			a: &HTTPService{
+				Service:     Service{Object: svc(), ServicePort: port()},
+				UpstreamTLS: &UpstreamTLS{Mode: UpstreamTLSMutual, SNI: "backend.internal", clientSecret: clientSecret("client-cert")},
+			},
+			b: &HTTPService{
+				Service:     Service{Object: svc(), ServicePort: port()},
+				UpstreamTLS: &UpstreamTLS{Mode: UpstreamTLSMutual, SNI: "backend.internal", clientSecret: clientSecret("client-cert")},
+			},
+			want: true,
+		},
+		"UpstreamTLS with distinct client secrets does not dedupe": {
+			a: &HTTPService{
+				Service:     Service{Object: svc(), ServicePort: port()},
+				UpstreamTLS: &UpstreamTLS{Mode: UpstreamTLSMutual, clientSecret: clientSecret("client-cert")},
+			},
+			b: &HTTPService{
+				Service:     Service{Object: svc(), ServicePort: port()},
+				UpstreamTLS: &UpstreamTLS{Mode: UpstreamTLSMutual, clientSecret: clientSecret("other-cert")},
+			},
+			want: false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := tc.a.toMeta() == tc.b.toMeta()
+			if got != tc.want {
+				t.Errorf("toMeta() equality = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}